@@ -0,0 +1,46 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package accountmap holds what the mapper and the UI have to agree on about
+// the Trillian Map of account IDs to balances.
+package accountmap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"strings"
+)
+
+// Index returns the map index holding the balance of account ID a. Without a
+// salt it's SHA256(a), with one it's HMAC-SHA256(salt, a) so that the indices
+// of known accounts can't be looked up without the salt.
+func Index(salt, a []byte) []byte {
+	if len(salt) == 0 {
+		r := sha256.Sum256(a)
+		return r[:]
+	}
+	h := hmac.New(sha256.New, salt)
+	h.Write(a)
+	return h.Sum(nil)
+}
+
+// treeNeedsInit is the message a Map server returns for a map which hasn't been
+// initialised. The server wraps it, losing the gRPC code, so match on the text.
+const treeNeedsInit = "tree needs initialising"
+
+// IsTreeNeedsInit returns whether err is the Map server saying that the map
+// hasn't been initialised.
+func IsTreeNeedsInit(err error) bool {
+	return err != nil && strings.Contains(err.Error(), treeNeedsInit)
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accountmap
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	account, _ := hex.DecodeString("31b98d14007bdee637298086988a0bbd31184523")
+	// Maps already built depend on these, so they must never change.
+	for _, tc := range []struct {
+		salt string
+		want string
+	}{
+		{salt: "", want: "11ef659a2f4b07f0726bd0b7135672cb525626eb8953b2fbd39d0f0ee2c6d021"},
+		{salt: "secret", want: "24df5185b09ae720d8258d5ab5bc742f1a01e32ce2ca224cc00584f4c8e23f5d"},
+	} {
+		if got := hex.EncodeToString(Index([]byte(tc.salt), account)); got != tc.want {
+			t.Errorf("Index(%q, %x)=%s, want %s", tc.salt, account, got, tc.want)
+		}
+	}
+}
@@ -17,18 +17,20 @@ package main
 import (
 	"context"
 	"flag"
+	"time"
 
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/dial"
 	"github.com/google/trillian-examples/etherslurp/follower"
-	"google.golang.org/grpc"
 )
 
 var (
-	geth        = flag.String("geth", "", "URL of the geth RPC server.")
-	trillianLog = flag.String("trillian_log", "", "URL of the Trillian Log RPC server.")
-	logID       = flag.Int64("log_id", 0, "Trillian LogID to populate.")
+	geth           = flag.String("geth", "", "URL of the geth RPC server.")
+	trillianLog    = flag.String("trillian_log", "", "URL of the Trillian Log RPC server.")
+	logID          = flag.Int64("log_id", 0, "Trillian LogID to populate.")
+	connectTimeout = flag.Duration("connect_timeout", 10*time.Second, "Maximum time to wait for connections to the Trillian servers.")
 )
 
 func main() {
@@ -44,7 +46,7 @@ func main() {
 		glog.Exitf("Failed to dial geth: %v", err)
 	}
 
-	tc, err := grpc.Dial(*trillianLog, grpc.WithInsecure())
+	tc, err := dial.Dial(ctx, *trillianLog, *connectTimeout)
 	if err != nil {
 		glog.Exitf("Failed to dial Trillian Log: %v", err)
 	}
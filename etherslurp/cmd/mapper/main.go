@@ -16,22 +16,187 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/dial"
 	"github.com/google/trillian-examples/etherslurp/mapper"
+	"github.com/google/trillian/client"
+	"github.com/google/trillian/crypto/keyspb"
+	"github.com/google/trillian/crypto/sigpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var (
-	trillianLog = flag.String("trillian_log", "", "URL of the Trillian Log RPC server.")
-	trillianMap = flag.String("trillian_map", "", "URL of the Trillian Map RPC server.")
-	logID       = flag.Int64("log_id", 0, "Trillian LogID to populate.")
-	mapID       = flag.Int64("map_id", 0, "Trillian MapID to populate.")
-	from        = flag.Int64("from", 0, "Block to start at.")
+	trillianLog     = flag.String("trillian_log", "", "URL of the Trillian Log RPC server.")
+	trillianMap     = flag.String("trillian_map", "", "URL of the Trillian Map RPC server.")
+	logID           = flag.Int64("log_id", 0, "Trillian LogID to populate.")
+	mapID           = flag.Int64("map_id", 0, "Trillian MapID to populate.")
+	from            = flag.Int64("from", 0, "Block to start at.")
+	gossipURL       = flag.String("gossip_url", "", "If set, URL to POST each new signed map root to.")
+	limit           = flag.Int64("limit", 0, "If non-zero, stop after mapping this many blocks.")
+	verifyOnWrite   = flag.Bool("verify_on_write", false, "Read back and verify the map leaves after each write.")
+	trialDecode     = flag.Bool("trial_decode", true, "Check the first log leaf decodes as a block before starting.")
+	freshMap        = flag.Bool("fresh_map", false, "Create a new map on the --trillian_map server and populate that, instead of using --map_id.")
+	httpEndpoint    = flag.String("http_endpoint", "", "If set, address to serve the /pause, /resume and /healthz control endpoints on.")
+	indexSalt       = flag.String("index_salt", "", "If set, map indices are HMAC-SHA256(index_salt, account) rather than SHA256(account). Changing it orphans all existing balances, so it needs a fresh map.")
+	runTimeout      = flag.Duration("run_timeout", 0, "If non-zero, stop mapping (at the end of the current block) after this long.")
+	retryMaxDelay   = flag.Duration("retry_max_delay", time.Minute, "Maximum delay between retries of failed log fetches.")
+	retryMaxElapsed = flag.Duration("retry_max_elapsed", 0, "If non-zero, give up if log fetches keep failing for this long.")
+	connectTimeout  = flag.Duration("connect_timeout", 10*time.Second, "Maximum time to wait for connections to the Trillian servers.")
+	caCert          = flag.String("ca_cert", "", "If set, connect to the Trillian servers over TLS, trusting the CA certificates in this PEM file.")
+	clientCert      = flag.String("client_cert", "", "If set, PEM file with the certificate to present to the Trillian servers. Needs --ca_cert and --client_key.")
+	clientKey       = flag.String("client_key", "", "PEM file with the private key for --client_cert.")
+	rootOut         = flag.String("root_out", "", "If set, file to write the final signed map root to, as JSON, when mapping stops.")
 )
 
+// transportOption returns the dial option setting up transport security for
+// the Trillian connections, as configured by --ca_cert, --client_cert and
+// --client_key.
+func transportOption() (grpc.DialOption, error) {
+	if *caCert == "" {
+		if *clientCert != "" || *clientKey != "" {
+			return nil, errors.New("--client_cert and --client_key need --ca_cert")
+		}
+		return grpc.WithInsecure(), nil
+	}
+	pem, err := ioutil.ReadFile(*caCert)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", *caCert)
+	}
+	cfg := &tls.Config{RootCAs: pool}
+	if (*clientCert == "") != (*clientKey == "") {
+		return nil, errors.New("set both or neither of --client_cert and --client_key")
+	}
+	if *clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
+
+// createMap creates and initialises a new map tree, set up in the same way as
+// the Makefile's createmap target.
+func createMap(ctx context.Context, conn *grpc.ClientConn) (int64, error) {
+	req := &trillian.CreateTreeRequest{
+		Tree: &trillian.Tree{
+			TreeState:          trillian.TreeState_ACTIVE,
+			TreeType:           trillian.TreeType_MAP,
+			HashStrategy:       trillian.HashStrategy_TEST_MAP_HASHER,
+			HashAlgorithm:      sigpb.DigitallySigned_SHA256,
+			SignatureAlgorithm: sigpb.DigitallySigned_ECDSA,
+			DisplayName:        "etherslurp",
+			MaxRootDuration:    ptypes.DurationProto(0),
+		},
+		KeySpec: &keyspb.Specification{
+			Params: &keyspb.Specification_EcdsaParams{EcdsaParams: &keyspb.Specification_ECDSA{}},
+		},
+	}
+	tree, err := client.CreateAndInitTree(ctx, req, trillian.NewTrillianAdminClient(conn), trillian.NewTrillianMapClient(conn), nil)
+	if err != nil {
+		return 0, err
+	}
+	return tree.TreeId, nil
+}
+
+// serveControl serves HTTP endpoints to pause and resume m, and to report on
+// its state.
+func serveControl(m *mapper.Mapper) {
+	mux := http.NewServeMux()
+	control := func(path string, f func()) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodPost {
+				http.Error(w, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			glog.Infof("Got %s request", path)
+			f()
+		})
+	}
+	control("/pause", m.Pause)
+	control("/resume", m.Resume)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		state := "running"
+		if m.Paused() {
+			state = "paused"
+		}
+		fmt.Fprintf(w, "ok\n%s\n", state)
+		if smr := m.LatestRoot(); smr != nil {
+			fmt.Fprintf(w, "map revision: %d\n", smr.MapRevision)
+		}
+		fmt.Fprintf(w, "new accounts: %d\n", m.NewAccounts())
+	})
+	glog.Exitf("Control HTTP server failed: %v", http.ListenAndServe(*httpEndpoint, mux))
+}
+
+// rootFile is the format of the --root_out file.
+type rootFile struct {
+	MapID       int64  `json:"map_id"`
+	MapRevision int64  `json:"map_revision"`
+	RootHash    []byte `json:"root_hash"`
+	// NextBlock is the first block not included in this root.
+	NextBlock     int64                   `json:"next_block"`
+	SignedMapRoot *trillian.SignedMapRoot `json:"signed_map_root"`
+}
+
+// writeRoot writes smr to path, via a temporary file so that readers never see
+// a partly written root.
+func writeRoot(path string, smr *trillian.SignedMapRoot, next int64) error {
+	b, err := json.MarshalIndent(rootFile{
+		MapID:         smr.MapId,
+		MapRevision:   smr.MapRevision,
+		RootHash:      smr.RootHash,
+		NextBlock:     next,
+		SignedMapRoot: smr,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// TempFile makes the file private, but it's meant to be read by other
+	// verification processes.
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// timeoutExitCode is the exit code used when --run_timeout expires, following
+// the timeout(1) convention.
+const timeoutExitCode = 124
+
 func main() {
 	flag.Parse()
 	ctx := context.Background()
@@ -39,20 +204,84 @@ func main() {
 	if *logID == 0 {
 		glog.Exitf("LogID is set to zero, I don't believe you! Set --log_id")
 	}
-	if *mapID == 0 {
-		glog.Exitf("MapID is set to zero, I don't believe you! Set --map_id")
+	if *freshMap && *mapID != 0 {
+		glog.Exitf("Set only one of --map_id and --fresh_map")
+	}
+	if *mapID == 0 && !*freshMap {
+		glog.Exitf("MapID is set to zero, I don't believe you! Set --map_id or --fresh_map")
+	}
+
+	transport, err := transportOption()
+	if err != nil {
+		glog.Exitf("Invalid TLS flags: %v", err)
 	}
 
-	tlc, err := grpc.Dial(*trillianLog, grpc.WithInsecure())
+	tlc, err := dial.Dial(ctx, *trillianLog, *connectTimeout, transport)
 	if err != nil {
 		glog.Exitf("Failed to dial Trillian Log: %v", err)
 	}
 
-	tmc, err := grpc.Dial(*trillianMap, grpc.WithInsecure())
+	// Check the log before a --fresh_map is created, so that a bad log
+	// doesn't leave behind an empty map.
+	if *trialDecode {
+		if err := mapper.TrialDecode(ctx, trillian.NewTrillianLogClient(tlc), *logID); err != nil {
+			glog.Exitf("Trial decode failed: %v", err)
+		}
+	}
+
+	tmc, err := dial.Dial(ctx, *trillianMap, *connectTimeout, transport)
 	if err != nil {
-		//		glog.Exitf("Failed to dial Trillian Map: %v", err)
+		glog.Exitf("Failed to dial Trillian Map: %v", err)
+	}
+
+	if *freshMap {
+		id, err := createMap(ctx, tmc)
+		if err != nil {
+			glog.Exitf("Failed to create new map: %v", err)
+		}
+		glog.Infof("Created new map %d, the previous map (if any) is untouched and can be deleted separately", id)
+		// Like createtree, print the new ID on stdout for scripts to pick up.
+		fmt.Println(id)
+		*mapID = id
 	}
 
-	m := mapper.New(trillian.NewTrillianLogClient(tlc), *logID, trillian.NewTrillianMapClient(tmc), *mapID)
-	m.Map(ctx, *from)
+	m := mapper.New(trillian.NewTrillianLogClient(tlc), *logID, trillian.NewTrillianMapClient(tmc), *mapID, mapper.MapperOpts{
+		GossipURL:       *gossipURL,
+		Limit:           *limit,
+		VerifyOnWrite:   *verifyOnWrite,
+		IndexSalt:       []byte(*indexSalt),
+		RetryMaxDelay:   *retryMaxDelay,
+		RetryMaxElapsed: *retryMaxElapsed,
+	})
+	if *httpEndpoint != "" {
+		go serveControl(m)
+	}
+	runCtx := ctx
+	if *runTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, *runTimeout)
+		defer cancel()
+	}
+	next, mapErr := m.Map(runCtx, *from)
+	glog.Infof("Added %d new accounts to map %d, next block to map is %d", m.NewAccounts(), *mapID, next)
+	if *rootOut != "" {
+		// Map only returns between blocks, and each block's write has
+		// completed by then, so this is the root covering every block before
+		// next.
+		if smr := m.LatestRoot(); smr == nil {
+			glog.Warningf("Nothing was written to the map, not writing --root_out")
+		} else if err := writeRoot(*rootOut, smr, next); err != nil {
+			glog.Exitf("Failed to write map root to %q: %v", *rootOut, err)
+		} else {
+			glog.Infof("Wrote map revision %d root to %q", smr.MapRevision, *rootOut)
+		}
+	}
+	if mapErr != nil {
+		glog.Exitf("Mapping stopped: %v; use --from=%d to carry on", mapErr, next)
+	}
+	if runCtx.Err() == context.DeadlineExceeded {
+		glog.Errorf("Run timed out after %v, use --from=%d to carry on", *runTimeout, next)
+		glog.Flush()
+		os.Exit(timeoutExitCode)
+	}
 }
@@ -15,19 +15,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/dial"
 	"github.com/google/trillian-examples/etherslurp/ui"
-	"google.golang.org/grpc"
 )
 
 var (
-	trillianMap = flag.String("trillian_map", "", "URL of the Trillian Map RPC server.")
-	mapID       = flag.Int64("map_id", 0, "Trillian MapID to populate.")
-	endpoint    = flag.String("http_endpint", "localhost:9001", "Address to bind HTTP server.")
+	trillianMap    = flag.String("trillian_map", "", "URL of the Trillian Map RPC server.")
+	mapID          = flag.Int64("map_id", 0, "Trillian MapID to populate.")
+	endpoint       = flag.String("http_endpint", "localhost:9001", "Address to bind HTTP server.")
+	drainTimeout   = flag.Duration("drain_timeout", 5*time.Second, "Maximum time to wait for in-flight HTTP requests to finish on shutdown.")
+	indexSalt      = flag.String("index_salt", "", "If set, map indices are HMAC-SHA256(index_salt, account) rather than SHA256(account); must match the mapper's.")
+	connectTimeout = flag.Duration("connect_timeout", 10*time.Second, "Maximum time to wait for connections to the Trillian servers.")
 )
 
 func main() {
@@ -37,11 +45,42 @@ func main() {
 		glog.Exitf("MapID is set to zero, I don't believe you! Set --map_id")
 	}
 
-	tmc, err := grpc.Dial(*trillianMap, grpc.WithInsecure())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		glog.Infof("Got signal %v, shutting down", sig)
+		cancel()
+	}()
+
+	tmc, err := dial.Dial(ctx, *trillianMap, *connectTimeout)
 	if err != nil {
-		//		glog.Exitf("Failed to dial Trillian Map: %v", err)
+		glog.Exitf("Failed to dial Trillian Map: %v", err)
 	}
 
-	ui := ui.New(trillian.NewTrillianMapClient(tmc), *mapID)
-	glog.Info(http.ListenAndServe(*endpoint, ui))
+	ui := ui.New(trillian.NewTrillianMapClient(tmc), *mapID, ui.UIOpts{
+		IndexSalt: []byte(*indexSalt),
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", ui)
+	mux.HandleFunc("/healthz", ui.ServeHealthz)
+	srv := &http.Server{Addr: *endpoint, Handler: mux}
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			glog.Errorf("Failed to shut down HTTP server cleanly: %v", err)
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		glog.Exitf("HTTP server failed: %v", err)
+	}
+	<-drained
 }
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The verify command checks an account balance against an inclusion proof and
+// signed map root, as shown by the UI, without talking to the Map server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/pubkey"
+	"github.com/google/trillian-examples/etherslurp/ui"
+	"github.com/google/trillian/client"
+	"github.com/google/trillian/merkle/maphasher"
+)
+
+var (
+	mapID     = flag.Int64("map_id", 0, "Trillian MapID the proof is from.")
+	account   = flag.String("account", "", "Hex encoded account ID to verify.")
+	leafValue = flag.String("leaf_value", "", "Raw leaf value (balance in wei) to verify, leave empty to verify the account is unknown.")
+	proofFile = flag.String("proof", "", "File containing the JSON inclusion proof.")
+	smrFile   = flag.String("smr", "", "File containing the JSON signed map root.")
+	indexSalt = flag.String("index_salt", "", "Index salt the map was built with, if any.")
+	mapPubKey = flag.String("map_public_key", "", "The Map's public key, to check the signed map root's signature. Given as "+pubkey.Forms+".")
+)
+
+// snippetLen is how many bytes either side of a JSON syntax error are shown.
+const snippetLen = 20
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, v)
+	if serr, ok := err.(*json.SyntaxError); ok {
+		start, end := serr.Offset-snippetLen, serr.Offset+snippetLen
+		if start < 0 {
+			start = 0
+		}
+		if end > int64(len(b)) {
+			end = int64(len(b))
+		}
+		return fmt.Errorf("%v at byte %d, near %q", err, serr.Offset, b[start:end])
+	}
+	return err
+}
+
+func main() {
+	flag.Parse()
+
+	if *mapID == 0 {
+		glog.Exitf("MapID is set to zero, I don't believe you! Set --map_id")
+	}
+	if *account == "" {
+		glog.Exitf("No account given, set --account")
+	}
+
+	idx, err := ui.AccountIndex(*account, []byte(*indexSalt))
+	if err != nil {
+		glog.Exitf("Invalid --account: %v", err)
+	}
+
+	var proof [][]byte
+	if err := readJSON(*proofFile, &proof); err != nil {
+		glog.Exitf("Failed to read inclusion proof from %q: %v", *proofFile, err)
+	}
+
+	var smr trillian.SignedMapRoot
+	if err := readJSON(*smrFile, &smr); err != nil {
+		glog.Exitf("Failed to read signed map root from %q: %v", *smrFile, err)
+	}
+
+	if *mapPubKey != "" {
+		pub, err := pubkey.Load(*mapPubKey)
+		if err != nil {
+			glog.Exitf("Failed to load --map_public_key: %v", err)
+		}
+		v := &client.MapVerifier{Hasher: maphasher.Default, PubKey: pub}
+		if err := v.VerifySignedMapRoot(&smr); err != nil {
+			glog.Exitf("INVALID: bad signed map root signature: %v", err)
+		}
+	}
+
+	if err := ui.VerifyLeaf(*mapID, idx, []byte(*leafValue), proof, &smr); err != nil {
+		glog.Exitf("INVALID: %v", err)
+	}
+	if *mapPubKey == "" {
+		// Without the key anyone could have made up a consistent root and
+		// proof, so don't claim more than was checked.
+		fmt.Println("VALID inclusion proof, map root signature not checked (set --map_public_key)")
+		return
+	}
+	fmt.Println("VALID")
+}
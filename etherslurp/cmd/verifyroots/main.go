@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The verifyroots command fetches the latest signed log and map roots and
+// checks their signatures, without replaying anything.
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/dial"
+	"github.com/google/trillian-examples/etherslurp/pubkey"
+	"github.com/google/trillian/client"
+	"github.com/google/trillian/merkle/maphasher"
+	"github.com/google/trillian/merkle/rfc6962"
+	"google.golang.org/grpc"
+)
+
+var (
+	trillianLog    = flag.String("trillian_log", "", "URL of the Trillian Log RPC server.")
+	trillianMap    = flag.String("trillian_map", "", "URL of the Trillian Map RPC server.")
+	logID          = flag.Int64("log_id", 0, "Trillian LogID to verify.")
+	mapID          = flag.Int64("map_id", 0, "Trillian MapID to verify.")
+	logPublicKey   = flag.String("log_public_key", "", "The Log's public key, given as "+pubkey.Forms+".")
+	mapPublicKey   = flag.String("map_public_key", "", "The Map's public key, given as "+pubkey.Forms+".")
+	connectTimeout = flag.Duration("connect_timeout", 10*time.Second, "Maximum time to wait for connections to the Trillian servers.")
+)
+
+func verifyLogRoot(ctx context.Context, conn *grpc.ClientConn, pub crypto.PublicKey) (*trillian.SignedLogRoot, error) {
+	resp, err := trillian.NewTrillianLogClient(conn).GetLatestSignedLogRoot(ctx, &trillian.GetLatestSignedLogRootRequest{LogId: *logID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest signed log root: %v", err)
+	}
+	if resp.SignedLogRoot == nil {
+		return nil, errors.New("log returned no signed log root")
+	}
+	// With an empty trusted root only the signature is checked.
+	v := client.NewLogVerifier(rfc6962.DefaultHasher, pub)
+	if err := v.VerifyRoot(&trillian.SignedLogRoot{}, resp.SignedLogRoot, nil); err != nil {
+		return nil, err
+	}
+	return resp.SignedLogRoot, nil
+}
+
+func verifyMapRoot(ctx context.Context, conn *grpc.ClientConn, pub crypto.PublicKey) (*trillian.SignedMapRoot, error) {
+	resp, err := trillian.NewTrillianMapClient(conn).GetSignedMapRoot(ctx, &trillian.GetSignedMapRootRequest{MapId: *mapID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest signed map root: %v", err)
+	}
+	if resp.MapRoot == nil {
+		return nil, errors.New("map returned no signed map root")
+	}
+	v := &client.MapVerifier{Hasher: maphasher.Default, PubKey: pub}
+	if err := v.VerifySignedMapRoot(resp.MapRoot); err != nil {
+		return nil, err
+	}
+	return resp.MapRoot, nil
+}
+
+func main() {
+	flag.Parse()
+	ctx := context.Background()
+
+	if *logID == 0 {
+		glog.Exitf("LogID is set to zero, I don't believe you! Set --log_id")
+	}
+	if *mapID == 0 {
+		glog.Exitf("MapID is set to zero, I don't believe you! Set --map_id")
+	}
+
+	logPub, err := pubkey.Load(*logPublicKey)
+	if err != nil {
+		glog.Exitf("Failed to load --log_public_key: %v", err)
+	}
+	mapPub, err := pubkey.Load(*mapPublicKey)
+	if err != nil {
+		glog.Exitf("Failed to load --map_public_key: %v", err)
+	}
+
+	tlc, err := dial.Dial(ctx, *trillianLog, *connectTimeout)
+	if err != nil {
+		glog.Exitf("Failed to dial Trillian Log: %v", err)
+	}
+	tmc, err := dial.Dial(ctx, *trillianMap, *connectTimeout)
+	if err != nil {
+		glog.Exitf("Failed to dial Trillian Map: %v", err)
+	}
+
+	slr, err := verifyLogRoot(ctx, tlc, logPub)
+	if err != nil {
+		glog.Exitf("Log root is INVALID: %v", err)
+	}
+	fmt.Printf("Log root VALID: tree size %d, root hash %x\n", slr.TreeSize, slr.RootHash)
+
+	smr, err := verifyMapRoot(ctx, tmc, mapPub)
+	if err != nil {
+		glog.Exitf("Map root is INVALID: %v", err)
+	}
+	fmt.Printf("Map root VALID: revision %d, root hash %x\n", smr.MapRevision, smr.RootHash)
+}
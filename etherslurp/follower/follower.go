@@ -23,6 +23,7 @@ import (
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/progress"
 )
 
 type FollowerOpts struct {
@@ -52,6 +53,7 @@ func New(gc *ethclient.Client, tc trillian.TrillianLogClient, logID int64, opts
 func (f *Follower) Follow(ctx context.Context) {
 	ticker := time.NewTicker(time.Second)
 	nextBlock := int64(-1)
+	var p progress.Tracker
 nextAttempt:
 	for {
 		select {
@@ -108,7 +110,12 @@ nextAttempt:
 				continue nextAttempt
 			}
 			if nextBlock%1000 == 0 {
-				glog.Infof("Copied to %v", nextBlock)
+				p.Update(nextBlock, time.Now())
+				if p.Rate() > 0 {
+					glog.Infof("Copied to %v, %.1f blocks/s, %v until block %d", nextBlock, p.Rate(), p.ETA(int64(sync.CurrentBlock)).Round(time.Second), sync.CurrentBlock)
+				} else {
+					glog.Infof("Copied to %v", nextBlock)
+				}
 			}
 		}
 	}
@@ -15,16 +15,26 @@
 package mapper
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/accountmap"
+	"github.com/google/trillian-examples/etherslurp/progress"
+	"github.com/google/trillian/client/backoff"
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/maphasher"
 )
 
 const (
@@ -33,24 +43,63 @@ const (
 
 var oneEtherRatio = big.NewFloat(float64(1) / float64(oneEther))
 
+type MapperOpts struct {
+	// GossipURL, if set, is sent a POST of each new signed map root.
+	GossipURL string
+	// Limit, if non-zero, is the number of blocks to map before Map returns.
+	Limit int64
+	// VerifyOnWrite causes each write to be read back and checked.
+	VerifyOnWrite bool
+	// IndexSalt, if set, is used as an HMAC key when deriving map indices from
+	// account IDs, so that they can't be found by hashing known addresses.
+	IndexSalt []byte
+	// RetryMaxDelay caps the exponential backoff between failed log fetches.
+	RetryMaxDelay time.Duration
+	// RetryMaxElapsed, if non-zero, is how long log fetches may keep failing
+	// before the mapper gives up.
+	RetryMaxElapsed time.Duration
+}
+
 type Mapper struct {
 	logID, mapID int64
 	tlog         trillian.TrillianLogClient
 	tmap         trillian.TrillianMapClient
+	opts         MapperOpts
+	gossipClient *http.Client
 
 	unsortedBlocks chan *types.Block
 	sortedBlocks   chan *types.Block
+	// fetchErr is where fetchBlocks reports why it gave up.
+	fetchErr chan error
+
+	mu         sync.Mutex
+	latestRoot *trillian.SignedMapRoot
+
+	// paused is non-zero while Map is paused, access it atomically.
+	paused int32
+	// treeSize is the log's tree size as last seen by fetchBlocks, access it
+	// atomically.
+	treeSize int64
+	// newAccounts counts the map leaves this Mapper has written for the first
+	// time, access it atomically.
+	newAccounts int64
 }
 
-func New(tl trillian.TrillianLogClient, logID int64, tm trillian.TrillianMapClient, mapID int64) *Mapper {
+func New(tl trillian.TrillianLogClient, logID int64, tm trillian.TrillianMapClient, mapID int64, opts MapperOpts) *Mapper {
+	if opts.RetryMaxDelay <= 0 {
+		opts.RetryMaxDelay = time.Minute
+	}
 	return &Mapper{
-		logID: logID,
-		mapID: mapID,
-		tlog:  tl,
-		tmap:  tm,
+		logID:        logID,
+		mapID:        mapID,
+		tlog:         tl,
+		tmap:         tm,
+		opts:         opts,
+		gossipClient: &http.Client{Timeout: 10 * time.Second},
 
 		unsortedBlocks: make(chan *types.Block, 200),
 		sortedBlocks:   make(chan *types.Block, 200),
+		fetchErr:       make(chan error, 1),
 	}
 }
 
@@ -58,7 +107,59 @@ const maxNumBlocks int64 = 100
 
 var numBlocks = maxNumBlocks
 
+// latestTreeSize returns the tree size of the latest signed log root.
+func (m *Mapper) latestTreeSize(ctx context.Context) (int64, error) {
+	sth, err := m.tlog.GetLatestSignedLogRoot(ctx, &trillian.GetLatestSignedLogRootRequest{LogId: m.logID})
+	if err != nil {
+		return 0, err
+	}
+	if sth.SignedLogRoot == nil {
+		return 0, errors.New("log returned no signed log root")
+	}
+	return sth.SignedLogRoot.TreeSize, nil
+}
+
 func (m *Mapper) fetchBlocks(ctx context.Context, from int64) {
+	// treeSize is the size of the log as of the last signed log root we
+	// fetched, we never request leaves beyond it.
+	treeSize := int64(0)
+
+	b := &backoff.Backoff{Min: time.Second, Max: m.opts.RetryMaxDelay, Factor: 2}
+	var failingSince time.Time
+	retries := 0
+	// retry waits before trying again after a failure, no longer than the
+	// rest of RetryMaxElapsed. If fetches have been failing for longer than
+	// that it instead reports to Map that fetching has given up, and returns
+	// false.
+	retry := func() bool {
+		if retries == 0 {
+			failingSince = time.Now()
+		}
+		wait := b.Duration()
+		if max := m.opts.RetryMaxElapsed; max > 0 {
+			left := max - time.Since(failingSince)
+			if left <= 0 {
+				m.fetchErr <- fmt.Errorf("fetching from the log has failed for %v (%d retries), giving up", time.Since(failingSince), retries)
+				return false
+			}
+			if wait > left {
+				wait = left
+			}
+		}
+		retries++
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		return true
+	}
+	succeeded := func() {
+		if retries > 0 {
+			glog.Infof("Fetching from the log recovered after %d retries over %v", retries, time.Since(failingSince))
+		}
+		retries = 0
+		b.Reset()
+	}
 nextAttempt:
 	for {
 		select {
@@ -67,19 +168,49 @@ nextAttempt:
 		default:
 		}
 
-		leaves := make([]int64, numBlocks)
-		for i := int64(0); i < numBlocks; i++ {
+		if from >= treeSize {
+			s, err := m.latestTreeSize(ctx)
+			if err != nil {
+				glog.Errorf("Failed to get latest signed log root: %v", err)
+				if !retry() {
+					return
+				}
+				continue nextAttempt
+			}
+			succeeded()
+			if s <= from {
+				// Caught up, wait for the log to grow.
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				continue nextAttempt
+			}
+			glog.V(1).Infof("Log tree size is now %d", s)
+			treeSize = s
+			atomic.StoreInt64(&m.treeSize, s)
+		}
+
+		count := numBlocks
+		if from+count > treeSize {
+			count = treeSize - from
+		}
+		leaves := make([]int64, count)
+		for i := int64(0); i < count; i++ {
 			leaves[i] = from + i
 		}
 
 		entries, err := m.tlog.GetLeavesByIndex(ctx, &trillian.GetLeavesByIndexRequest{LogId: m.logID, LeafIndex: leaves})
 		if err != nil {
-			glog.Errorf("Failed to get %d leaves starting at index %d: %v", numBlocks, from, err)
+			glog.Errorf("Failed to get %d leaves starting at index %d: %v", count, from, err)
 			numBlocks /= 2
 			if numBlocks == 0 {
 				numBlocks = 1
 			}
-			time.Sleep(time.Second)
+			if !retry() {
+				return
+			}
 			continue nextAttempt
 		}
 		if numBlocks < maxNumBlocks {
@@ -90,13 +221,51 @@ nextAttempt:
 			block := &types.Block{}
 			if err := rlp.DecodeBytes(l.LeafValue, block); err != nil {
 				glog.Errorf("Failed to decode block from log at index %d: %v", l.LeafIndex, err)
+				if !retry() {
+					return
+				}
 				continue nextAttempt
 			}
-			m.unsortedBlocks <- block
+			select {
+			case <-ctx.Done():
+				return
+			case m.unsortedBlocks <- block:
+			}
 		}
+		succeeded()
+
+		from += count
+	}
+}
 
-		from += numBlocks
+// TrialDecode fetches and decodes the first leaf in log logID, so that a log
+// which doesn't contain blocks is noticed straight away. It only needs the log,
+// so it can be run before a map is created.
+func TrialDecode(ctx context.Context, tl trillian.TrillianLogClient, logID int64) error {
+	sth, err := tl.GetLatestSignedLogRoot(ctx, &trillian.GetLatestSignedLogRootRequest{LogId: logID})
+	if err != nil {
+		return fmt.Errorf("failed to get latest signed log root: %v", err)
+	}
+	if sth.SignedLogRoot == nil {
+		return errors.New("log returned no signed log root")
+	}
+	if sth.SignedLogRoot.TreeSize == 0 {
+		glog.Infof("Log %d is empty, nothing to trial decode", logID)
+		return nil
+	}
+	entries, err := tl.GetLeavesByIndex(ctx, &trillian.GetLeavesByIndexRequest{LogId: logID, LeafIndex: []int64{0}})
+	if err != nil {
+		return fmt.Errorf("failed to get leaf 0: %v", err)
 	}
+	if len(entries.Leaves) != 1 {
+		return fmt.Errorf("got %d leaves for index 0, expected 1", len(entries.Leaves))
+	}
+	block := &types.Block{}
+	if err := rlp.DecodeBytes(entries.Leaves[0].LeafValue, block); err != nil {
+		return fmt.Errorf("leaf 0 isn't an RLP encoded block (is log %d one populated by the follower?): %v", logID, err)
+	}
+	glog.Infof("Leaf 0 of log %d is block %v (hash %x) with %d transactions", logID, block.Number(), block.Hash(), len(block.Transactions()))
+	return nil
 }
 
 func (m *Mapper) pipelineBlocks(ctx context.Context, from int64) {
@@ -106,8 +275,6 @@ nextAttempt:
 	for {
 		select {
 		case <-ctx.Done():
-			for range m.unsortedBlocks {
-			}
 			return
 		case b := <-m.unsortedBlocks:
 			blocksByNumber[b.Number().Int64()] = b
@@ -118,7 +285,11 @@ nextAttempt:
 					continue nextAttempt
 				}
 				delete(blocksByNumber, from)
-				m.sortedBlocks <- b
+				select {
+				case <-ctx.Done():
+					return
+				case m.sortedBlocks <- b:
+				}
 				from++
 			}
 		}
@@ -167,9 +338,9 @@ func fmtAddress(a []byte) string {
 	return fmt.Sprintf("%x", a[:])
 }
 
-func index(a []byte) string {
-	r := sha256.Sum256(a)
-	return string(r[:])
+// index returns the map index for account ID a.
+func (m *Mapper) index(a []byte) string {
+	return string(accountmap.Index(m.opts.IndexSalt, a))
 }
 
 func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error {
@@ -183,7 +354,7 @@ func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error
 	deltas := make(map[string]*big.Int)
 
 	// Add miner credit
-	minerIndex := index(b.Coinbase().Bytes())
+	minerIndex := m.index(b.Coinbase().Bytes())
 	credit := big.NewInt(int64(5) * int64(1+len(b.Uncles())/32))
 	glog.Infof("Miner credit: %s", credit.String())
 	credit.Mul(credit, big.NewInt(oneEther))
@@ -201,7 +372,7 @@ func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error
 		}
 
 		// Handle sender costs
-		sIndex := index(from.Bytes())
+		sIndex := m.index(from.Bytes())
 		sBal, ok := deltas[sIndex]
 		if !ok {
 			sBal = big.NewInt(0)
@@ -215,7 +386,7 @@ func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error
 			continue
 		}
 
-		rIndex := index(to.Bytes())
+		rIndex := m.index(to.Bytes())
 		rBal, ok := deltas[rIndex]
 		if !ok {
 			rBal = big.NewInt(0)
@@ -246,6 +417,13 @@ func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error
 
 	glog.V(1).Info("Get map leaves...")
 	get, err := m.tmap.GetLeaves(ctx, getRequest)
+	if accountmap.IsTreeNeedsInit(err) {
+		glog.Infof("Map %d hasn't been initialised yet, initialising it", m.mapID)
+		if _, err := m.tmap.InitMap(ctx, &trillian.InitMapRequest{MapId: m.mapID}); err != nil {
+			return fmt.Errorf("failed to initialise map: %v", err)
+		}
+		get, err = m.tmap.GetLeaves(ctx, getRequest)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get current balances: %v", err)
 	}
@@ -260,7 +438,14 @@ func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error
 		Leaves: make([]*trillian.MapLeaf, 0),
 	}
 
+	var added int64
 	for _, l := range get.MapLeafInclusion {
+		if l.Leaf == nil {
+			return fmt.Errorf("map returned an inclusion proof with no leaf")
+		}
+		if len(l.Leaf.LeafValue) == 0 {
+			added++
+		}
 		bal := big.NewInt(0)
 		if len(l.Leaf.LeafValue) > 0 {
 			var ok bool
@@ -273,8 +458,7 @@ func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error
 		k := string(l.Leaf.Index)
 		d, ok := deltas[k]
 		if !ok {
-			glog.Warning("No delta for leaf index %x", l.Leaf.Index)
-			continue
+			return fmt.Errorf("map returned leaf for index %x, which wasn't requested", l.Leaf.Index)
 		}
 		delete(deltas, k)
 		glog.V(1).Infof("index %x... had: %s", l.Leaf.Index[:5], ethBalance(bal))
@@ -289,23 +473,167 @@ func (m *Mapper) mapTransactionsFrom(ctx context.Context, b *types.Block) error
 	}
 
 	glog.V(1).Infof("Setting %d map leaves.", len(setRequest.Leaves))
-	_, err = m.tmap.SetLeaves(ctx, setRequest)
+	set, err := m.tmap.SetLeaves(ctx, setRequest)
 	if err != nil {
 		return fmt.Errorf("failed to update balances: %v", err)
 	}
+	if set.MapRoot == nil {
+		return fmt.Errorf("map returned no root after updating balances")
+	}
+	atomic.AddInt64(&m.newAccounts, added)
+	prev := m.LatestRoot()
+	m.updateRoot(set.MapRoot)
+	if m.opts.VerifyOnWrite {
+		if err := m.verifyWrite(ctx, setRequest.Leaves, set.MapRoot.MapRevision); err != nil {
+			return fmt.Errorf("failed to verify write: %v", err)
+		}
+	}
+	if m.opts.GossipURL != "" {
+		if err := m.gossip(ctx, set.MapRoot, prev); err != nil {
+			glog.Warningf("Failed to gossip map root at revision %d: %v", set.MapRoot.MapRevision, err)
+		}
+	}
 
 	return nil
 }
 
-func (m *Mapper) Map(ctx context.Context, from int64) {
-	go m.fetchBlocks(ctx, 0)
-	go m.pipelineBlocks(ctx, 0)
+// verifyWrite reads back leaves which have just been written at map revision
+// rev, and checks that they hold the values written and have valid inclusion
+// proofs.
+func (m *Mapper) verifyWrite(ctx context.Context, leaves []*trillian.MapLeaf, rev int64) error {
+	start := time.Now()
+	getRequest := &trillian.GetMapLeavesRequest{MapId: m.mapID}
+	written := make(map[string][]byte)
+	for _, l := range leaves {
+		getRequest.Index = append(getRequest.Index, l.Index)
+		written[string(l.Index)] = l.LeafValue
+	}
+	get, err := m.tmap.GetLeaves(ctx, getRequest)
+	if err != nil {
+		return fmt.Errorf("failed to read back leaves: %v", err)
+	}
+	if get.MapRoot == nil {
+		return fmt.Errorf("map returned no root with the leaves read back")
+	}
+	// An older root wouldn't include the write, so its proofs prove nothing.
+	if got := get.MapRoot.MapRevision; got < rev {
+		return fmt.Errorf("read back leaves at map revision %d, before the write at revision %d", got, rev)
+	}
+	if got, want := len(get.MapLeafInclusion), len(leaves); got != want {
+		return fmt.Errorf("read back %d leaves, wrote %d", got, want)
+	}
+	for _, l := range get.MapLeafInclusion {
+		if l.Leaf == nil {
+			return fmt.Errorf("map returned an inclusion proof with no leaf")
+		}
+		v, ok := written[string(l.Leaf.Index)]
+		if !ok {
+			return fmt.Errorf("read back leaf at index %x, which wasn't written", l.Leaf.Index)
+		}
+		if !bytes.Equal(l.Leaf.LeafValue, v) {
+			return fmt.Errorf("index %x has value %q, wrote %q", l.Leaf.Index, l.Leaf.LeafValue, v)
+		}
+		if err := merkle.VerifyMapInclusionProof(m.mapID, l.Leaf.Index, l.Leaf.LeafValue, get.MapRoot.RootHash, l.Inclusion, maphasher.Default); err != nil {
+			return fmt.Errorf("invalid inclusion proof for index %x: %v", l.Leaf.Index, err)
+		}
+	}
+	glog.V(1).Infof("Verified %d written leaves in %v", len(leaves), time.Since(start))
+	return nil
+}
+
+// gossipMessage is the body POSTed to MapperOpts.GossipURL.
+type gossipMessage struct {
+	MapRoot *trillian.SignedMapRoot `json:"map_root"`
+	// PreviousMapRoot is the root this mapper saw before MapRoot, if any.
+	PreviousMapRoot *trillian.SignedMapRoot `json:"previous_map_root,omitempty"`
+}
 
+// gossip sends smr, along with the previous root prev, to the gossip endpoint
+// so that witnesses can keep track of the map's roots.
+func (m *Mapper) gossip(ctx context.Context, smr, prev *trillian.SignedMapRoot) error {
+	body, err := json.Marshal(gossipMessage{MapRoot: smr, PreviousMapRoot: prev})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, m.opts.GossipURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.gossipClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("gossip endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// updateRoot records the map root returned by a write. Each write should
+// advance the map revision by exactly one, anything else is logged.
+func (m *Mapper) updateRoot(smr *trillian.SignedMapRoot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if prev := m.latestRoot; prev != nil {
+		switch d := smr.MapRevision - prev.MapRevision; {
+		case d <= 0:
+			glog.Warningf("Map revision didn't advance after write (was %d, now %d), was the write dropped?", prev.MapRevision, smr.MapRevision)
+			return
+		case d > 1:
+			glog.Warningf("Map revision jumped from %d to %d, is something else writing to map %d?", prev.MapRevision, smr.MapRevision, m.mapID)
+		}
+	}
+	glog.V(1).Infof("Map is now at revision %d", smr.MapRevision)
+	m.latestRoot = smr
+}
+
+// LatestRoot returns the signed map root from the most recent write, or nil if
+// nothing has been written yet.
+func (m *Mapper) LatestRoot() *trillian.SignedMapRoot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latestRoot
+}
+
+// NewAccounts returns the number of accounts this Mapper has added to the map,
+// that is leaves which were empty before it wrote them. A zero balance is
+// written as "0", so leaves are never emptied again and, for a map built in a
+// single run, this is the number of accounts the map holds.
+func (m *Mapper) NewAccounts() int64 {
+	return atomic.LoadInt64(&m.newAccounts)
+}
+
+// Map maps blocks, starting at block number from, until ctx is done, Limit
+// blocks have been mapped or fetching from the log gives up. It returns the
+// number of the next block to map, and why fetching gave up if it did.
+func (m *Mapper) Map(ctx context.Context, from int64) (int64, error) {
+	// Fetching stops as soon as ctx is done, but a block which has started
+	// being mapped is always finished so that we stop on a block boundary.
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go m.fetchBlocks(fetchCtx, 0)
+	go m.pipelineBlocks(fetchCtx, 0)
+
+	start := from
+	var p progress.Tracker
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return from, nil
+		case err := <-m.fetchErr:
+			return from, err
 		case nextBlock := <-m.sortedBlocks:
+			for m.Paused() {
+				select {
+				case <-ctx.Done():
+					return from, nil
+				case err := <-m.fetchErr:
+					return from, err
+				case <-time.After(time.Second):
+				}
+			}
 			if nextBlock.Number().Int64() < from {
 				continue
 			}
@@ -313,10 +641,40 @@ func (m *Mapper) Map(ctx context.Context, from int64) {
 				glog.Exitf("Got unexpected block number %s, wanted %d", nextBlock.Number(), from)
 			}
 			// TODO(al): batching...
-			if err := m.mapTransactionsFrom(ctx, nextBlock); err != nil {
+			if err := m.mapTransactionsFrom(context.Background(), nextBlock); err != nil {
 				glog.Exitf("Couldn't map transactions from block %v", err)
 			}
 			from++
+			if from%1000 == 0 {
+				p.Update(from, time.Now())
+				// There's one block per log leaf, so the tree size is the
+				// block number Map is heading for.
+				size := atomic.LoadInt64(&m.treeSize)
+				if p.Rate() > 0 && size > from {
+					glog.Infof("Mapped to block %d, %.1f blocks/s, %v until block %d", from, p.Rate(), p.ETA(size).Round(time.Second), size)
+				} else {
+					glog.Infof("Mapped to block %d", from)
+				}
+			}
+			if m.opts.Limit > 0 && from-start >= m.opts.Limit {
+				glog.Infof("Mapped %d blocks (%d to %d), stopping; use --from=%d to carry on", from-start, start, from-1, from)
+				return from, nil
+			}
 		}
 	}
 }
+
+// Pause stops Map from mapping any more blocks until Resume is called.
+func (m *Mapper) Pause() {
+	atomic.StoreInt32(&m.paused, 1)
+}
+
+// Resume lets a paused Map carry on.
+func (m *Mapper) Resume() {
+	atomic.StoreInt32(&m.paused, 0)
+}
+
+// Paused returns whether Map is currently paused.
+func (m *Mapper) Paused() bool {
+	return atomic.LoadInt32(&m.paused) != 0
+}
@@ -0,0 +1,365 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testLogID = 1
+	testMapID = 2
+)
+
+var (
+	miner     = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	recipient = common.HexToAddress("0x00000000000000000000000000000000000000bb")
+)
+
+// testBlock returns block number n, containing numTX transactions from a new
+// account, each paying 1000 wei to recipient at a cost of 21000 wei. It also
+// returns the sending account.
+func testBlock(t *testing.T, n int64, numTX int) (*types.Block, common.Address) {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+	var txs []*types.Transaction
+	for i := 0; i < numTX; i++ {
+		tx, err := types.SignTx(types.NewTransaction(uint64(i), recipient, big.NewInt(1000), 21000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatalf("SignTx(): %v", err)
+		}
+		txs = append(txs, tx)
+	}
+	h := &types.Header{Number: big.NewInt(n), Coinbase: miner, Difficulty: big.NewInt(1)}
+	return types.NewBlockWithHeader(h).WithBody(txs, nil), crypto.PubkeyToAddress(key.PublicKey)
+}
+
+func balance(m *Mapper, tm *testonly.MapClient, a common.Address) string {
+	return string(tm.Leaf([]byte(m.index(a.Bytes()))))
+}
+
+func TestMapTransactionsFrom(t *testing.T) {
+	tm := testonly.NewMapClient(testMapID, false)
+	m := New(nil, testLogID, tm, testMapID, MapperOpts{})
+	b, sender := testBlock(t, 1, 2)
+
+	if err := m.mapTransactionsFrom(context.Background(), b); err != nil {
+		t.Fatalf("mapTransactionsFrom(): %v", err)
+	}
+	// The map started off uninitialised, so the mapper should have
+	// initialised it and carried on.
+	if got, want := tm.Calls("InitMap"), 1; got != want {
+		t.Errorf("InitMap called %d times, want %d", got, want)
+	}
+	for _, tc := range []struct {
+		desc string
+		a    common.Address
+		want string
+	}{
+		{desc: "miner", a: miner, want: "5000000000000000000"},
+		{desc: "sender", a: sender, want: "-44000"},
+		{desc: "recipient", a: recipient, want: "2000"},
+	} {
+		if got := balance(m, tm, tc.a); got != tc.want {
+			t.Errorf("%s has balance %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+	if got, want := m.NewAccounts(), int64(3); got != want {
+		t.Errorf("NewAccounts()=%d, want %d", got, want)
+	}
+	if got, want := m.LatestRoot().GetMapRevision(), int64(1); got != want {
+		t.Errorf("LatestRoot() revision %d, want %d", got, want)
+	}
+}
+
+func TestMapTransactionsFromBadResponses(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		fault   testonly.Fault
+		wantErr string
+	}{
+		{
+			desc:    "GetLeaves fails",
+			fault:   testonly.Fault{Method: "GetLeaves", Err: status.Error(codes.Unavailable, "down")},
+			wantErr: "failed to get current balances",
+		},
+		{
+			desc: "unrequested index",
+			fault: testonly.RewriteGetLeaves(0, func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion[0].Leaf.Index = bytes.Repeat([]byte{1}, 32)
+			}),
+			wantErr: "wasn't requested",
+		},
+		{
+			desc: "repeated index",
+			fault: testonly.RewriteGetLeaves(0, func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion[1].Leaf.Index = r.MapLeafInclusion[0].Leaf.Index
+			}),
+			wantErr: "wasn't requested",
+		},
+		{
+			desc: "no leaf",
+			fault: testonly.RewriteGetLeaves(0, func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion[0].Leaf = nil
+			}),
+			wantErr: "no leaf",
+		},
+		{
+			desc: "no root after SetLeaves",
+			fault: testonly.RewriteSetLeaves(0, func(r *trillian.SetMapLeavesResponse) {
+				r.MapRoot = nil
+			}),
+			wantErr: "no root",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			tm := testonly.NewMapClient(testMapID, true)
+			tm.AddFault(tc.fault)
+			m := New(nil, testLogID, tm, testMapID, MapperOpts{})
+			b, _ := testBlock(t, 1, 1)
+
+			err := m.mapTransactionsFrom(context.Background(), b)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("mapTransactionsFrom(): %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyOnWrite(t *testing.T) {
+	// The first GetLeaves reads the old balances, the second reads back the
+	// new ones.
+	const readBack = 2
+	for _, tc := range []struct {
+		desc    string
+		faults  []testonly.Fault
+		wantErr string
+	}{
+		{desc: "valid"},
+		{
+			desc: "wrong value",
+			faults: []testonly.Fault{testonly.RewriteGetLeaves(readBack, func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion[0].Leaf.LeafValue = []byte("1")
+			})},
+			wantErr: "has value",
+		},
+		{
+			desc: "bad proof",
+			faults: []testonly.Fault{testonly.RewriteGetLeaves(readBack, func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion[0].Inclusion[0] = bytes.Repeat([]byte{1}, 32)
+			})},
+			wantErr: "invalid inclusion proof",
+		},
+		{
+			desc: "no root",
+			faults: []testonly.Fault{testonly.RewriteGetLeaves(readBack, func(r *trillian.GetMapLeavesResponse) {
+				r.MapRoot = nil
+			})},
+			wantErr: "no root",
+		},
+		{
+			desc: "stale root",
+			faults: []testonly.Fault{testonly.RewriteGetLeaves(readBack, func(r *trillian.GetMapLeavesResponse) {
+				r.MapRoot.MapRevision--
+			})},
+			wantErr: "before the write",
+		},
+		{
+			desc:    "read back fails",
+			faults:  []testonly.Fault{{Method: "GetLeaves", Call: readBack, Err: status.Error(codes.Unavailable, "down")}},
+			wantErr: "failed to read back",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			tm := testonly.NewMapClient(testMapID, true)
+			for _, f := range tc.faults {
+				tm.AddFault(f)
+			}
+			m := New(nil, testLogID, tm, testMapID, MapperOpts{VerifyOnWrite: true})
+			b, _ := testBlock(t, 1, 1)
+
+			err := m.mapTransactionsFrom(context.Background(), b)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("mapTransactionsFrom(): %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("mapTransactionsFrom(): %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// testLog returns a fake log holding the given blocks.
+func testLog(t *testing.T, blocks ...*types.Block) *testonly.LogClient {
+	t.Helper()
+	tl := testonly.NewLogClient(testLogID)
+	for _, b := range blocks {
+		raw, err := rlp.EncodeToBytes(b)
+		if err != nil {
+			t.Fatalf("EncodeToBytes(): %v", err)
+		}
+		tl.Append(raw)
+	}
+	return tl
+}
+
+func TestMap(t *testing.T) {
+	b0, _ := testBlock(t, 0, 0)
+	b1, _ := testBlock(t, 1, 1)
+	b2, _ := testBlock(t, 2, 1)
+	tl := testLog(t, b0, b1, b2)
+	// A failed fetch should be retried.
+	tl.AddFault(testonly.Fault{Method: "GetLeavesByIndex", Call: 1, Err: status.Error(codes.Unavailable, "down")})
+	tm := testonly.NewMapClient(testMapID, true)
+	m := New(tl, testLogID, tm, testMapID, MapperOpts{Limit: 3})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	next, err := m.Map(ctx, 0)
+	if err != nil {
+		t.Fatalf("Map(): %v", err)
+	}
+	if got, want := next, int64(3); got != want {
+		t.Errorf("Map() returned next block %d, want %d", got, want)
+	}
+	// Block 0 has no transactions, so it isn't written.
+	if got, want := m.LatestRoot().GetMapRevision(), int64(2); got != want {
+		t.Errorf("LatestRoot() revision %d, want %d", got, want)
+	}
+	if got, want := balance(m, tm, recipient), "2000"; got != want {
+		t.Errorf("recipient has balance %q, want %q", got, want)
+	}
+}
+
+func TestMapGivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		fault testonly.Fault
+	}{
+		{desc: "log down", fault: testonly.Fault{Method: "GetLatestSignedLogRoot", Err: status.Error(codes.Unavailable, "down")}},
+		{desc: "no log root", fault: testonly.RewriteGetLatestSignedLogRoot(0, func(r *trillian.GetLatestSignedLogRootResponse) {
+			r.SignedLogRoot = nil
+		})},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			tl := testLog(t)
+			tl.AddFault(tc.fault)
+			tm := testonly.NewMapClient(testMapID, true)
+			// The first retry would wait a second, give up well before.
+			const maxElapsed = 100 * time.Millisecond
+			m := New(tl, testLogID, tm, testMapID, MapperOpts{RetryMaxDelay: time.Minute, RetryMaxElapsed: maxElapsed})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			start := time.Now()
+			next, err := m.Map(ctx, 5)
+			if took := time.Since(start); took > 10*maxElapsed {
+				t.Errorf("Map() took %v to give up, want about %v", took, maxElapsed)
+			}
+			if err == nil || !strings.Contains(err.Error(), "giving up") {
+				t.Errorf("Map(): %v, want giving up error", err)
+			}
+			if ctx.Err() != nil {
+				t.Errorf("Map() only returned when the context was done")
+			}
+			if got, want := next, int64(5); got != want {
+				t.Errorf("Map() returned next block %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestTrialDecode(t *testing.T) {
+	b, _ := testBlock(t, 0, 1)
+	for _, tc := range []struct {
+		desc    string
+		tl      *testonly.LogClient
+		faults  []testonly.Fault
+		wantErr string
+	}{
+		{desc: "block", tl: testLog(t, b)},
+		{desc: "empty log", tl: testLog(t)},
+		{desc: "not a block", tl: testonly.NewLogClient(testLogID, []byte("not a block")), wantErr: "isn't an RLP encoded block"},
+		{
+			desc: "no log root",
+			tl:   testLog(t, b),
+			faults: []testonly.Fault{testonly.RewriteGetLatestSignedLogRoot(0, func(r *trillian.GetLatestSignedLogRootResponse) {
+				r.SignedLogRoot = nil
+			})},
+			wantErr: "no signed log root",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			for _, f := range tc.faults {
+				tc.tl.AddFault(f)
+			}
+			err := TrialDecode(context.Background(), tc.tl, testLogID)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("TrialDecode(): %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("TrialDecode(): %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMapStopsFetching(t *testing.T) {
+	// Enough blocks to fill both of the Mapper's channels, so that the fetch
+	// goroutines are blocked sending when Map returns.
+	var blocks []*types.Block
+	for i := int64(0); i < 600; i++ {
+		b, _ := testBlock(t, i, 0)
+		blocks = append(blocks, b)
+	}
+	tl := testLog(t, blocks...)
+	tm := testonly.NewMapClient(testMapID, true)
+	m := New(tl, testLogID, tm, testMapID, MapperOpts{Limit: 1})
+
+	before := runtime.NumGoroutine()
+	if _, err := m.Map(context.Background(), 0); err != nil {
+		t.Fatalf("Map(): %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running after Map returned, had %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package progress estimates how long long-running block copies and scans
+// have left to go.
+package progress
+
+import "time"
+
+// rateSmoothing is the weight given to the newest sample in the moving average
+// of the rate.
+const rateSmoothing = 0.2
+
+// Tracker tracks how quickly blocks are being processed. The rate is an
+// exponential moving average so that the ETA doesn't jump around with the
+// speed of individual blocks.
+type Tracker struct {
+	when  time.Time
+	block int64
+	rate  float64 // blocks/sec
+}
+
+// Update records that block had been reached at time now.
+func (p *Tracker) Update(block int64, now time.Time) {
+	if !p.when.IsZero() {
+		if d := now.Sub(p.when).Seconds(); d > 0 {
+			r := float64(block-p.block) / d
+			if p.rate == 0 {
+				p.rate = r
+			} else {
+				p.rate = rateSmoothing*r + (1-rateSmoothing)*p.rate
+			}
+		}
+	}
+	p.when, p.block = now, block
+}
+
+// Rate returns the smoothed rate in blocks/sec, or zero until there have been
+// two updates.
+func (p *Tracker) Rate() float64 {
+	return p.rate
+}
+
+// ETA estimates how long it'll take to reach block target at the current rate.
+func (p *Tracker) ETA(target int64) time.Duration {
+	return time.Duration(float64(target-p.block) / p.rate * float64(time.Second))
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pubkey loads the public keys of Trillian trees from command line
+// flags.
+package pubkey
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/trillian/crypto/keys/pem"
+	"github.com/google/trillian/crypto/sigpb"
+
+	tcrypto "github.com/google/trillian/crypto"
+)
+
+// Forms describes the forms Load accepts, for use in flag help text.
+const Forms = "a PEM file path, an inline PEM key, base64:<base64 PEM> or env:<VARIABLE>"
+
+// Load parses a public key given as one of:
+//   - env:NAME, the key is in environment variable NAME, in one of the forms
+//     below;
+//   - base64:DATA, DATA is a base64 encoded PEM key;
+//   - an inline PEM key;
+//   - otherwise, the path of a PEM file.
+func Load(spec string) (crypto.PublicKey, error) {
+	if strings.HasPrefix(spec, "env:") {
+		name := strings.TrimPrefix(spec, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		spec = v
+	}
+
+	var pub crypto.PublicKey
+	var err error
+	switch {
+	case strings.HasPrefix(spec, "base64:"):
+		var b []byte
+		b, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(spec, "base64:"))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode base64 key: %v", err)
+		}
+		pub, err = pem.UnmarshalPublicKey(string(b))
+	case strings.HasPrefix(strings.TrimSpace(spec), "-----BEGIN"):
+		pub, err = pem.UnmarshalPublicKey(spec)
+	default:
+		pub, err = pem.ReadPublicKeyFile(spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tcrypto.SignatureAlgorithm(pub) == sigpb.DigitallySigned_ANONYMOUS {
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return pub, nil
+}
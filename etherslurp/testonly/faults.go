@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testonly contains fakes of the Trillian Log and Map clients for
+// testing etherslurp. The fakes can be told to fail or delay chosen calls, or
+// to tamper with their responses, to test how etherslurp copes with errors and
+// malformed responses.
+//
+// Faults apply to whole calls. There's no way to fail just one leaf of a
+// batch, as the Trillian servers fail or succeed a batch as a whole; rewrite
+// the response to corrupt a single leaf instead.
+package testonly
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Fault describes how a fake should misbehave on a call.
+type Fault struct {
+	// Method is the name of the client method, e.g. "GetLeaves".
+	Method string
+	// Call picks which call to Method misbehaves, counting from 1. Zero
+	// means every call.
+	Call int
+	// Delay is how long to wait before handling the call. The wait is cut
+	// short, and the context's error returned, if the call's context is done.
+	Delay time.Duration
+	// Err, if set, is returned instead of handling the call. Use status.Error
+	// to return a particular gRPC code.
+	Err error
+	// Rewrite, if set, is passed the response (e.g. a
+	// *trillian.GetMapLeavesResponse) to tamper with before it's returned.
+	Rewrite func(resp interface{})
+}
+
+// Faults keeps track of the calls made to a fake, and injects the Faults added
+// to it into them.
+type Faults struct {
+	mu     sync.Mutex
+	calls  map[string]int
+	faults []Fault
+}
+
+// AddFault makes f apply to future calls.
+func (fs *Faults) AddFault(f Fault) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults = append(fs.faults, f)
+}
+
+// Calls returns how many times method has been called.
+func (fs *Faults) Calls(method string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls[method]
+}
+
+// begin records a call to method and applies any delays and errors set up for
+// it. It returns the rewrites to apply to the call's response.
+func (fs *Faults) begin(ctx context.Context, method string) ([]func(interface{}), error) {
+	fs.mu.Lock()
+	if fs.calls == nil {
+		fs.calls = make(map[string]int)
+	}
+	fs.calls[method]++
+	call := fs.calls[method]
+	var matched []Fault
+	for _, f := range fs.faults {
+		if f.Method == method && (f.Call == 0 || f.Call == call) {
+			matched = append(matched, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	var rewrites []func(interface{})
+	for _, f := range matched {
+		if f.Delay > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(f.Delay):
+			}
+		}
+		if f.Err != nil {
+			return nil, f.Err
+		}
+		if f.Rewrite != nil {
+			rewrites = append(rewrites, f.Rewrite)
+		}
+	}
+	return rewrites, nil
+}
+
+// rewrite applies rewrites to resp, and returns it.
+func rewrite(rewrites []func(interface{}), resp interface{}) interface{} {
+	for _, r := range rewrites {
+		r(resp)
+	}
+	return resp
+}
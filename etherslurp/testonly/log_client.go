@@ -0,0 +1,97 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testonly
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/trillian"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LogClient is an in-memory fake of trillian.TrillianLogClient. It supports
+// GetLatestSignedLogRoot and GetLeavesByIndex; other methods panic. Its roots
+// are neither hashed nor signed.
+type LogClient struct {
+	trillian.TrillianLogClient
+	Faults
+
+	logID int64
+
+	mu     sync.Mutex
+	leaves [][]byte
+}
+
+// RewriteGetLatestSignedLogRoot returns a Fault which passes the response of
+// GetLatestSignedLogRoot call number call (counting from 1, or zero for every
+// call) to f to tamper with.
+func RewriteGetLatestSignedLogRoot(call int, f func(*trillian.GetLatestSignedLogRootResponse)) Fault {
+	return Fault{Method: "GetLatestSignedLogRoot", Call: call, Rewrite: func(resp interface{}) {
+		f(resp.(*trillian.GetLatestSignedLogRootResponse))
+	}}
+}
+
+// NewLogClient returns a fake client for log logID, holding leaves.
+func NewLogClient(logID int64, leaves ...[]byte) *LogClient {
+	return &LogClient{logID: logID, leaves: leaves}
+}
+
+// Append adds leaves to the end of the log.
+func (c *LogClient) Append(leaves ...[]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leaves = append(c.leaves, leaves...)
+}
+
+// GetLatestSignedLogRoot returns a root giving the log's size.
+func (c *LogClient) GetLatestSignedLogRoot(ctx context.Context, req *trillian.GetLatestSignedLogRootRequest, opts ...grpc.CallOption) (*trillian.GetLatestSignedLogRootResponse, error) {
+	rewrites, err := c.begin(ctx, "GetLatestSignedLogRoot")
+	if err != nil {
+		return nil, err
+	}
+	if req.LogId != c.logID {
+		return nil, status.Errorf(codes.NotFound, "no log %d", req.LogId)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := &trillian.GetLatestSignedLogRootResponse{
+		SignedLogRoot: &trillian.SignedLogRoot{LogId: c.logID, TreeSize: int64(len(c.leaves))},
+	}
+	return rewrite(rewrites, resp).(*trillian.GetLatestSignedLogRootResponse), nil
+}
+
+// GetLeavesByIndex returns the requested leaves.
+func (c *LogClient) GetLeavesByIndex(ctx context.Context, req *trillian.GetLeavesByIndexRequest, opts ...grpc.CallOption) (*trillian.GetLeavesByIndexResponse, error) {
+	rewrites, err := c.begin(ctx, "GetLeavesByIndex")
+	if err != nil {
+		return nil, err
+	}
+	if req.LogId != c.logID {
+		return nil, status.Errorf(codes.NotFound, "no log %d", req.LogId)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := &trillian.GetLeavesByIndexResponse{}
+	for _, i := range req.LeafIndex {
+		if i < 0 || i >= int64(len(c.leaves)) {
+			return nil, status.Errorf(codes.OutOfRange, "leaf %d is beyond the tree size %d", i, len(c.leaves))
+		}
+		resp.Leaves = append(resp.Leaves, &trillian.LogLeaf{LeafIndex: i, LeafValue: c.leaves[i]})
+	}
+	return rewrite(rewrites, resp).(*trillian.GetLeavesByIndexResponse), nil
+}
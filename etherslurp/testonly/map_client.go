@@ -0,0 +1,193 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testonly
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/merkle/maphasher"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MapClient is an in-memory fake of trillian.TrillianMapClient, for a map using
+// the TEST_MAP_HASHER strategy. It supports GetLeaves, SetLeaves,
+// GetSignedMapRoot and InitMap; other methods panic. Its inclusion proofs are
+// real, but its roots aren't signed.
+type MapClient struct {
+	trillian.TrillianMapClient
+	Faults
+
+	mapID int64
+
+	mu          sync.Mutex
+	initialised bool
+	revision    int64
+	leaves      map[string][]byte
+}
+
+// RewriteGetLeaves returns a Fault which passes the response of GetLeaves call
+// number call (counting from 1, or zero for every call) to f to tamper with.
+func RewriteGetLeaves(call int, f func(*trillian.GetMapLeavesResponse)) Fault {
+	return Fault{Method: "GetLeaves", Call: call, Rewrite: func(resp interface{}) {
+		f(resp.(*trillian.GetMapLeavesResponse))
+	}}
+}
+
+// RewriteSetLeaves is like RewriteGetLeaves, for SetLeaves.
+func RewriteSetLeaves(call int, f func(*trillian.SetMapLeavesResponse)) Fault {
+	return Fault{Method: "SetLeaves", Call: call, Rewrite: func(resp interface{}) {
+		f(resp.(*trillian.SetMapLeavesResponse))
+	}}
+}
+
+// RewriteGetSignedMapRoot is like RewriteGetLeaves, for GetSignedMapRoot.
+func RewriteGetSignedMapRoot(call int, f func(*trillian.GetSignedMapRootResponse)) Fault {
+	return Fault{Method: "GetSignedMapRoot", Call: call, Rewrite: func(resp interface{}) {
+		f(resp.(*trillian.GetSignedMapRootResponse))
+	}}
+}
+
+// NewMapClient returns a fake client for an empty map mapID. Like a newly
+// created map, it fails reads and writes until InitMap is called, unless
+// initialised is set.
+func NewMapClient(mapID int64, initialised bool) *MapClient {
+	return &MapClient{
+		mapID:       mapID,
+		initialised: initialised,
+		leaves:      make(map[string][]byte),
+	}
+}
+
+// Leaf returns the value at index, or nil if it's unset.
+func (c *MapClient) Leaf(index []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leaves[string(index)]
+}
+
+// check returns the error the Map server would return for a request for map
+// mapID while in the current state. It must be called with c.mu held.
+func (c *MapClient) check(mapID int64) error {
+	if mapID != c.mapID {
+		return status.Errorf(codes.NotFound, "no map %d", mapID)
+	}
+	if !c.initialised {
+		// The real server loses the code, see accountmap.IsTreeNeedsInit.
+		return status.Error(codes.Unknown, "getting latest root: tree needs initialising")
+	}
+	return nil
+}
+
+// root returns the map's current root. It must be called with c.mu held.
+func (c *MapClient) root() *trillian.SignedMapRoot {
+	return &trillian.SignedMapRoot{
+		MapId:       c.mapID,
+		MapRevision: c.revision,
+		RootHash:    rootHash(c.mapID, c.leaves),
+	}
+}
+
+// GetLeaves returns the leaves at the requested indices, with inclusion proofs.
+func (c *MapClient) GetLeaves(ctx context.Context, req *trillian.GetMapLeavesRequest, opts ...grpc.CallOption) (*trillian.GetMapLeavesResponse, error) {
+	rewrites, err := c.begin(ctx, "GetLeaves")
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(req.MapId); err != nil {
+		return nil, err
+	}
+	resp := &trillian.GetMapLeavesResponse{MapRoot: c.root()}
+	for _, idx := range req.Index {
+		if got, want := len(idx), maphasher.Default.Size(); got != want {
+			return nil, status.Errorf(codes.InvalidArgument, "index is %d bytes, want %d", got, want)
+		}
+		resp.MapLeafInclusion = append(resp.MapLeafInclusion, &trillian.MapLeafInclusion{
+			Leaf: &trillian.MapLeaf{
+				Index:     append([]byte(nil), idx...),
+				LeafValue: append([]byte(nil), c.leaves[string(idx)]...),
+			},
+			Inclusion: inclusionProof(c.mapID, c.leaves, idx),
+		})
+	}
+	return rewrite(rewrites, resp).(*trillian.GetMapLeavesResponse), nil
+}
+
+// SetLeaves writes the given leaves, moving the map on to its next revision.
+func (c *MapClient) SetLeaves(ctx context.Context, req *trillian.SetMapLeavesRequest, opts ...grpc.CallOption) (*trillian.SetMapLeavesResponse, error) {
+	rewrites, err := c.begin(ctx, "SetLeaves")
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(req.MapId); err != nil {
+		return nil, err
+	}
+	for _, l := range req.Leaves {
+		if got, want := len(l.Index), maphasher.Default.Size(); got != want {
+			return nil, status.Errorf(codes.InvalidArgument, "index is %d bytes, want %d", got, want)
+		}
+	}
+	for _, l := range req.Leaves {
+		if len(l.LeafValue) == 0 {
+			delete(c.leaves, string(l.Index))
+			continue
+		}
+		c.leaves[string(l.Index)] = append([]byte(nil), l.LeafValue...)
+	}
+	c.revision++
+	resp := &trillian.SetMapLeavesResponse{MapRoot: c.root()}
+	return rewrite(rewrites, resp).(*trillian.SetMapLeavesResponse), nil
+}
+
+// GetSignedMapRoot returns the map's current root.
+func (c *MapClient) GetSignedMapRoot(ctx context.Context, req *trillian.GetSignedMapRootRequest, opts ...grpc.CallOption) (*trillian.GetSignedMapRootResponse, error) {
+	rewrites, err := c.begin(ctx, "GetSignedMapRoot")
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(req.MapId); err != nil {
+		return nil, err
+	}
+	resp := &trillian.GetSignedMapRootResponse{MapRoot: c.root()}
+	return rewrite(rewrites, resp).(*trillian.GetSignedMapRootResponse), nil
+}
+
+// InitMap initialises the map, which must not already have been initialised.
+func (c *MapClient) InitMap(ctx context.Context, req *trillian.InitMapRequest, opts ...grpc.CallOption) (*trillian.InitMapResponse, error) {
+	rewrites, err := c.begin(ctx, "InitMap")
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req.MapId != c.mapID {
+		return nil, status.Errorf(codes.NotFound, "no map %d", req.MapId)
+	}
+	if c.initialised {
+		return nil, status.Errorf(codes.AlreadyExists, "map %d is already initialised", c.mapID)
+	}
+	c.initialised = true
+	resp := &trillian.InitMapResponse{Created: c.root()}
+	return rewrite(rewrites, resp).(*trillian.InitMapResponse), nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testonly
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/maphasher"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testMapID = 42
+
+func testIndex(i int) []byte {
+	h := sha256.Sum256([]byte(fmt.Sprintf("account %d", i)))
+	return h[:]
+}
+
+func TestMapClientProofs(t *testing.T) {
+	ctx := context.Background()
+	c := NewMapClient(testMapID, true)
+	var indices [][]byte
+	for i := 0; i < 10; i++ {
+		indices = append(indices, testIndex(i))
+	}
+	// Write some of the leaves, so that proofs of both set and unset leaves
+	// are checked.
+	set := &trillian.SetMapLeavesRequest{MapId: testMapID}
+	for i, idx := range indices[:6] {
+		set.Leaves = append(set.Leaves, &trillian.MapLeaf{Index: idx, LeafValue: []byte(fmt.Sprint(i))})
+	}
+	setResp, err := c.SetLeaves(ctx, set)
+	if err != nil {
+		t.Fatalf("SetLeaves(): %v", err)
+	}
+	if got, want := setResp.MapRoot.MapRevision, int64(1); got != want {
+		t.Errorf("SetLeaves() revision=%d, want %d", got, want)
+	}
+
+	get, err := c.GetLeaves(ctx, &trillian.GetMapLeavesRequest{MapId: testMapID, Index: indices})
+	if err != nil {
+		t.Fatalf("GetLeaves(): %v", err)
+	}
+	for i, inc := range get.MapLeafInclusion {
+		want := ""
+		if i < 6 {
+			want = fmt.Sprint(i)
+		}
+		if got := string(inc.Leaf.LeafValue); got != want {
+			t.Errorf("leaf %d has value %q, want %q", i, got, want)
+		}
+		if err := merkle.VerifyMapInclusionProof(testMapID, inc.Leaf.Index, inc.Leaf.LeafValue, get.MapRoot.RootHash, inc.Inclusion, maphasher.Default); err != nil {
+			t.Errorf("leaf %d: VerifyMapInclusionProof(): %v", i, err)
+		}
+	}
+}
+
+func TestMapClientNeedsInit(t *testing.T) {
+	ctx := context.Background()
+	c := NewMapClient(testMapID, false)
+	req := &trillian.GetMapLeavesRequest{MapId: testMapID, Index: [][]byte{testIndex(0)}}
+	if _, err := c.GetLeaves(ctx, req); err == nil || !strings.Contains(err.Error(), "tree needs initialising") {
+		t.Fatalf("GetLeaves() before InitMap: %v, want tree needs initialising", err)
+	}
+	if _, err := c.InitMap(ctx, &trillian.InitMapRequest{MapId: testMapID}); err != nil {
+		t.Fatalf("InitMap(): %v", err)
+	}
+	if _, err := c.GetLeaves(ctx, req); err != nil {
+		t.Errorf("GetLeaves() after InitMap: %v", err)
+	}
+	if _, err := c.InitMap(ctx, &trillian.InitMapRequest{MapId: testMapID}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("second InitMap(): %v, want AlreadyExists", err)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	c := NewMapClient(testMapID, true)
+	c.AddFault(Fault{Method: "GetSignedMapRoot", Call: 2, Err: status.Error(codes.Unavailable, "down")})
+	c.AddFault(Fault{Method: "GetSignedMapRoot", Call: 3, Rewrite: func(resp interface{}) {
+		resp.(*trillian.GetSignedMapRootResponse).MapRoot = nil
+	}})
+
+	req := &trillian.GetSignedMapRootRequest{MapId: testMapID}
+	if resp, err := c.GetSignedMapRoot(ctx, req); err != nil || resp.MapRoot == nil {
+		t.Errorf("first call: %v, %v, want a root", resp, err)
+	}
+	if _, err := c.GetSignedMapRoot(ctx, req); status.Code(err) != codes.Unavailable {
+		t.Errorf("second call: %v, want Unavailable", err)
+	}
+	if resp, err := c.GetSignedMapRoot(ctx, req); err != nil || resp.MapRoot != nil {
+		t.Errorf("third call: %v, %v, want no root", resp, err)
+	}
+	if got, want := c.Calls("GetSignedMapRoot"), 3; got != want {
+		t.Errorf("Calls()=%d, want %d", got, want)
+	}
+}
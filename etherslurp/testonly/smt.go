@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testonly
+
+import (
+	"github.com/google/trillian/merkle/maphasher"
+)
+
+// hasher is the TEST_MAP_HASHER strategy's hasher. Its empty hashes don't
+// depend on the index, so nil is passed as the index throughout.
+var hasher = maphasher.Default
+
+type leafHash struct {
+	index, hash []byte
+}
+
+// bit returns bit i of index, counting from the most significant bit, which
+// picks the branch taken at depth i of the tree.
+func bit(index []byte, i int) byte {
+	return (index[i/8] >> uint(7-i%8)) & 1
+}
+
+// subtreeHash returns the hash of the subtree at height whose leaves are ls,
+// all of which are on the path to it, or nil if ls is empty.
+func subtreeHash(treeID int64, ls []leafHash, height int) []byte {
+	if len(ls) == 0 {
+		return nil
+	}
+	if height == 0 {
+		return ls[0].hash
+	}
+	depth := hasher.BitLen() - height
+	var left, right []leafHash
+	for _, l := range ls {
+		if bit(l.index, depth) == 0 {
+			left = append(left, l)
+		} else {
+			right = append(right, l)
+		}
+	}
+	l, r := subtreeHash(treeID, left, height-1), subtreeHash(treeID, right, height-1)
+	if l == nil {
+		l = hasher.HashEmpty(treeID, nil, height-1)
+	}
+	if r == nil {
+		r = hasher.HashEmpty(treeID, nil, height-1)
+	}
+	return hasher.HashChildren(l, r)
+}
+
+func hashLeaves(treeID int64, leaves map[string][]byte) []leafHash {
+	ls := make([]leafHash, 0, len(leaves))
+	for k, v := range leaves {
+		h, err := hasher.HashLeaf(treeID, []byte(k), v)
+		if err != nil {
+			// maphasher never returns an error.
+			panic(err)
+		}
+		ls = append(ls, leafHash{index: []byte(k), hash: h})
+	}
+	return ls
+}
+
+// rootHash returns the root hash of the sparse Merkle tree holding leaves.
+func rootHash(treeID int64, leaves map[string][]byte) []byte {
+	if h := subtreeHash(treeID, hashLeaves(treeID, leaves), hasher.BitLen()); h != nil {
+		return h
+	}
+	return hasher.HashEmpty(treeID, nil, hasher.BitLen())
+}
+
+// inclusionProof returns the inclusion proof for index in the sparse Merkle
+// tree holding leaves, in the format merkle.VerifyMapInclusionProof expects:
+// the sibling hashes from the leaf up, with nil for empty siblings.
+func inclusionProof(treeID int64, leaves map[string][]byte, index []byte) [][]byte {
+	ls := hashLeaves(treeID, leaves)
+	proof := make([][]byte, hasher.BitLen())
+	for height := range proof {
+		// The sibling at height shares the path to index down to depth,
+		// then branches the other way.
+		depth := hasher.BitLen() - height - 1
+		var sibling []leafHash
+		for _, l := range ls {
+			if onSiblingPath(l.index, index, depth) {
+				sibling = append(sibling, l)
+			}
+		}
+		proof[height] = subtreeHash(treeID, sibling, height)
+	}
+	return proof
+}
+
+// onSiblingPath returns whether a is under the sibling, at depth, of the path
+// to b. That is, a and b agree on their first depth bits, and differ on the
+// next.
+func onSiblingPath(a, b []byte, depth int) bool {
+	for i := 0; i < depth; i++ {
+		if bit(a, i) != bit(b, i) {
+			return false
+		}
+	}
+	return bit(a, depth) != bit(b, depth)
+}
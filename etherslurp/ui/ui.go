@@ -1,6 +1,7 @@
 package ui
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/accountmap"
 	"github.com/google/trillian/merkle"
 	"github.com/google/trillian/merkle/maphasher"
 )
@@ -26,11 +28,21 @@ const page = `
 	<form method="get">
 		AccountID: <input type="text" name="account"/><input type="submit" value="Go!"/>
 	</form>
+	<form method="get">
+		Map index (hex): <input type="text" name="index"/><input type="submit" value="Go!"/>
+	</form>
 	{{if .ErrorText}}
 		<font color="darkred">{{.ErrorText}}</font>
-	{{else if .AccountID}}
+	{{else if or .AccountID .Index}}
+	{{if .AccountID}}
 	Account <i>{{.AccountID}}</i><br/>
+	{{else}}
+	Map index <i>{{.Index}}</i><br/>
+	{{end}}
+	Raw leaf value <i>{{.LeafValue}}</i><br/>
+	{{if .Amount}}
 	Balance <i>{{.Amount}}</i><br/>
+	{{end}}
 	As at block <i>XXX</i><br/>
 	<br/>
 	<br/>
@@ -63,24 +75,36 @@ const (
 
 var oneEtherRatio = big.NewFloat(float64(1) / float64(oneEther))
 
-func New(tmc trillian.TrillianMapClient, mapID int64) *UI {
+type UIOpts struct {
+	// IndexSalt must match the mapper's MapperOpts.IndexSalt.
+	IndexSalt []byte
+}
+
+func New(tmc trillian.TrillianMapClient, mapID int64, opts UIOpts) *UI {
 	return &UI{
 		mapID: mapID,
 		tmc:   tmc,
 		tmpl:  template.Must(template.New("root").Parse(page)),
+		opts:  opts,
 	}
 }
 
 type UI struct {
 	mapID int64
+	opts  UIOpts
 	tmc   trillian.TrillianMapClient
 	tmpl  *template.Template
 }
 
-const keyAccount = "account"
+const (
+	keyAccount = "account"
+	keyIndex   = "index"
+)
 
 type accountInfo struct {
 	AccountID  string
+	Index      string
+	LeafValue  string
 	Amount     string
 	ErrorText  string
 	ProofValid bool
@@ -89,31 +113,76 @@ type accountInfo struct {
 	SMR        string
 }
 
-func index(a []byte) []byte {
-	r := sha256.Sum256(a)
-	return r[:]
+// AccountIndex returns the map index holding the balance of the hex encoded
+// account ID ac, in a map built with the given index salt (which may be empty).
+func AccountIndex(ac string, salt []byte) ([]byte, error) {
+	acBytes, err := hex.DecodeString(strings.TrimPrefix(ac, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode accountID hex string: %v", err)
+	}
+	return accountmap.Index(salt, acBytes), nil
+}
+
+// VerifyLeaf checks that proof shows leafValue to be the value at index idx in
+// the map whose root is smr. An empty leafValue verifies that idx is unset.
+// The root's signature isn't checked.
+func VerifyLeaf(mapID int64, idx, leafValue []byte, proof [][]byte, smr *trillian.SignedMapRoot) error {
+	// The test map hasher doesn't include the map ID in its hashes, so check
+	// it explicitly.
+	if smr.MapId != mapID {
+		return fmt.Errorf("map root is for map %d, not map %d", smr.MapId, mapID)
+	}
+	return merkle.VerifyMapInclusionProof(mapID, idx, leafValue, smr.RootHash, proof, maphasher.Default)
 }
 
 func (ui *UI) getLeaf(ctx context.Context, ac string) (*trillian.MapLeafInclusion, *trillian.SignedMapRoot, error) {
-	if strings.HasPrefix(ac, "0x") {
-		ac = ac[2:]
+	idx, err := AccountIndex(ac, ui.opts.IndexSalt)
+	if err != nil {
+		return nil, nil, err
 	}
-	acBytes, err := hex.DecodeString(ac)
+	return ui.getLeafByIndex(ctx, idx)
+}
+
+// getRawLeaf fetches the map leaf at the hex-encoded map index ix, bypassing
+// the account ID hashing done by getLeaf.
+func (ui *UI) getRawLeaf(ctx context.Context, ix string) (*trillian.MapLeafInclusion, *trillian.SignedMapRoot, error) {
+	ixBytes, err := hex.DecodeString(strings.TrimPrefix(ix, "0x"))
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't decode accountID hex string: %v", err)
+		return nil, nil, fmt.Errorf("couldn't decode index hex string: %v", err)
 	}
+	if got, want := len(ixBytes), sha256.Size; got != want {
+		return nil, nil, fmt.Errorf("index is %d bytes long, map indices are %d bytes", got, want)
+	}
+	return ui.getLeafByIndex(ctx, ixBytes)
+}
 
+func (ui *UI) getLeafByIndex(ctx context.Context, idx []byte) (*trillian.MapLeafInclusion, *trillian.SignedMapRoot, error) {
 	getRequest := &trillian.GetMapLeavesRequest{
 		MapId: ui.mapID,
-		Index: [][]byte{index(acBytes)},
+		Index: [][]byte{idx},
 	}
 
 	glog.Info("Get map leaves...")
 	get, err := ui.tmc.GetLeaves(ctx, getRequest)
+	if accountmap.IsTreeNeedsInit(err) {
+		return nil, nil, fmt.Errorf("map %d has no balances yet, has the mapper been run?", ui.mapID)
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get current balance for ac %v: %v", ac, err)
+		return nil, nil, fmt.Errorf("failed to get map leaf at index %x: %v", idx, err)
 	}
 	glog.Infof("Got %d map leaves.", len(get.MapLeafInclusion))
+	if got := len(get.MapLeafInclusion); got != 1 {
+		return nil, nil, fmt.Errorf("got %d map leaves for index %x, expected 1", got, idx)
+	}
+	if get.MapLeafInclusion[0].Leaf == nil {
+		return nil, nil, fmt.Errorf("map returned an inclusion proof with no leaf for index %x", idx)
+	}
+	if got := get.MapLeafInclusion[0].Leaf.Index; !bytes.Equal(got, idx) {
+		return nil, nil, fmt.Errorf("map returned leaf for index %x, requested %x", got, idx)
+	}
+	if get.MapRoot == nil {
+		return nil, nil, fmt.Errorf("map returned no root for index %x", idx)
+	}
 	return get.MapLeafInclusion[0], get.MapRoot, nil
 }
 
@@ -134,25 +203,41 @@ func jsonOrErr(a interface{}) string {
 
 func (ui *UI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	acString := req.FormValue(keyAccount)
+	ixString := req.FormValue(keyIndex)
 
 	var ac accountInfo
-	if acString != "" {
-		ac.AccountID = acString
-		leafInc, smr, err := ui.getLeaf(req.Context(), acString)
+	if acString != "" || ixString != "" {
+		var leafInc *trillian.MapLeafInclusion
+		var smr *trillian.SignedMapRoot
+		var err error
+		desc := fmt.Sprintf("Account %s", acString)
+		if acString != "" {
+			ac.AccountID = acString
+			leafInc, smr, err = ui.getLeaf(req.Context(), acString)
+		} else {
+			ac.Index = ixString
+			desc = fmt.Sprintf("Map index %s", ixString)
+			leafInc, smr, err = ui.getRawLeaf(req.Context(), ixString)
+		}
 		if err != nil {
 			ac.ErrorText = err.Error()
 		} else {
 			if len(leafInc.Leaf.LeafValue) == 0 {
-				ac.ErrorText = fmt.Sprintf("Account %s is unknown", acString)
+				ac.ErrorText = fmt.Sprintf("%s is unknown", desc)
 			} else {
+				ac.LeafValue = string(leafInc.Leaf.LeafValue)
 				bal := big.NewInt(0)
 				var ok bool
-				bal, ok = bal.SetString(string(leafInc.Leaf.LeafValue), 10)
-				if !ok {
-					ac.ErrorText = fmt.Sprintf("Couldn't parse account balance %v", string(leafInc.Leaf.LeafValue))
+				bal, ok = bal.SetString(ac.LeafValue, 10)
+				// Raw index lookups are for debugging, so still show the
+				// proof for leaves which don't hold a balance.
+				if !ok && ac.Index == "" {
+					ac.ErrorText = fmt.Sprintf("Couldn't parse account balance %v", ac.LeafValue)
 				} else {
-					ac.Amount = ethBalance(bal)
-					err := merkle.VerifyMapInclusionProof(ui.mapID, leafInc.Leaf.Index, leafInc.Leaf.LeafValue, smr.RootHash, leafInc.Inclusion, maphasher.Default)
+					if ok {
+						ac.Amount = ethBalance(bal)
+					}
+					err := VerifyLeaf(ui.mapID, leafInc.Leaf.Index, leafInc.Leaf.LeafValue, leafInc.Inclusion, smr)
 					if err != nil {
 						ac.ProofValid = false
 						ac.ProofDesc = fmt.Sprintf("INVALID: %s", err)
@@ -172,5 +257,20 @@ func (ui *UI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 }
 
+// ServeHealthz reports whether the map can be reached, along with its current
+// revision.
+func (ui *UI) ServeHealthz(w http.ResponseWriter, req *http.Request) {
+	smr, err := ui.tmc.GetSignedMapRoot(req.Context(), &trillian.GetSignedMapRootRequest{MapId: ui.mapID})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get signed map root: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if smr.MapRoot == nil {
+		http.Error(w, "map returned no root", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok\nmap revision: %d\n", smr.MapRoot.MapRevision)
+}
+
 func (ui *UI) sendSearchForm(w http.ResponseWriter) {
 }
@@ -0,0 +1,241 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian-examples/etherslurp/testonly"
+	"github.com/google/trillian/merkle/maphasher"
+)
+
+const testMapID = 12345
+
+// testAccount is an arbitrary Rinkeby account ID.
+const testAccount = "0x31b98d14007bdee637298086988a0bbd31184523"
+
+func TestVerifyLeaf(t *testing.T) {
+	idx, err := AccountIndex(testAccount, nil)
+	if err != nil {
+		t.Fatalf("AccountIndex(): %v", err)
+	}
+	h := maphasher.Default
+	// In an empty map every index is unset, and every proof node is empty.
+	emptyRoot := &trillian.SignedMapRoot{
+		MapId:    testMapID,
+		RootHash: h.HashEmpty(testMapID, nil, h.BitLen()),
+	}
+	emptyProof := make([][]byte, h.BitLen())
+	tamperedProof := make([][]byte, h.BitLen())
+	tamperedProof[0] = bytes.Repeat([]byte{1}, h.Size())
+
+	for _, tc := range []struct {
+		desc      string
+		mapID     int64
+		leafValue string
+		proof     [][]byte
+		wantErr   bool
+	}{
+		{desc: "valid", mapID: testMapID, proof: emptyProof},
+		{desc: "tampered value", mapID: testMapID, leafValue: "1000", proof: emptyProof, wantErr: true},
+		{desc: "tampered proof", mapID: testMapID, proof: tamperedProof, wantErr: true},
+		{desc: "short proof", mapID: testMapID, proof: emptyProof[1:], wantErr: true},
+		{desc: "wrong map ID", mapID: testMapID + 1, proof: emptyProof, wantErr: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := VerifyLeaf(tc.mapID, idx, []byte(tc.leafValue), tc.proof, emptyRoot)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("VerifyLeaf(): %v, want err: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// otherAccount is another arbitrary Rinkeby account ID.
+const otherAccount = "0x8f2defe1b2bf8e7b4a6ff0b8fa3bb3c4e4fc5b8a"
+
+// testMap returns a fake map holding testAccount's balance of 1000 wei, and
+// otherAccount's of 5 wei.
+func testMap(t *testing.T) *testonly.MapClient {
+	t.Helper()
+	tm := testonly.NewMapClient(testMapID, true)
+	req := &trillian.SetMapLeavesRequest{MapId: testMapID}
+	for ac, bal := range map[string]string{testAccount: "1000", otherAccount: "5"} {
+		idx, err := AccountIndex(ac, nil)
+		if err != nil {
+			t.Fatalf("AccountIndex(): %v", err)
+		}
+		req.Leaves = append(req.Leaves, &trillian.MapLeaf{Index: idx, LeafValue: []byte(bal)})
+	}
+	if _, err := tm.SetLeaves(context.Background(), req); err != nil {
+		t.Fatalf("SetLeaves(): %v", err)
+	}
+	return tm
+}
+
+func TestVerifyLeafInclusion(t *testing.T) {
+	idx, err := AccountIndex(testAccount, nil)
+	if err != nil {
+		t.Fatalf("AccountIndex(): %v", err)
+	}
+	get, err := testMap(t).GetLeaves(context.Background(), &trillian.GetMapLeavesRequest{MapId: testMapID, Index: [][]byte{idx}})
+	if err != nil {
+		t.Fatalf("GetLeaves(): %v", err)
+	}
+	inc, smr := get.MapLeafInclusion[0], get.MapRoot
+	otherRoot := *smr
+	otherRoot.RootHash = bytes.Repeat([]byte{1}, len(smr.RootHash))
+
+	for _, tc := range []struct {
+		desc      string
+		leafValue string
+		smr       *trillian.SignedMapRoot
+		wantErr   bool
+	}{
+		{desc: "valid", leafValue: "1000", smr: smr},
+		{desc: "tampered value", leafValue: "1001", smr: smr, wantErr: true},
+		{desc: "claimed unset", leafValue: "", smr: smr, wantErr: true},
+		{desc: "tampered root hash", leafValue: "1000", smr: &otherRoot, wantErr: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := VerifyLeaf(testMapID, idx, []byte(tc.leafValue), inc.Inclusion, tc.smr)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("VerifyLeaf(): %v, want err: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetLeafByIndex(t *testing.T) {
+	idx, err := AccountIndex(testAccount, nil)
+	if err != nil {
+		t.Fatalf("AccountIndex(): %v", err)
+	}
+	// getLeaves returns the faults to tamper with every GetLeaves response
+	// using f.
+	getLeaves := func(f func(*trillian.GetMapLeavesResponse)) []testonly.Fault {
+		return []testonly.Fault{testonly.RewriteGetLeaves(0, f)}
+	}
+	for _, tc := range []struct {
+		desc    string
+		faults  []testonly.Fault
+		wantErr string
+	}{
+		{desc: "valid"},
+		{
+			desc: "mismatched index",
+			faults: getLeaves(func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion[0].Leaf.Index = bytes.Repeat([]byte{1}, 32)
+			}),
+			wantErr: "requested",
+		},
+		{
+			desc: "no inclusions",
+			faults: getLeaves(func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion = nil
+			}),
+			wantErr: "got 0 map leaves",
+		},
+		{
+			desc: "two inclusions",
+			faults: getLeaves(func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion = append(r.MapLeafInclusion, r.MapLeafInclusion[0])
+			}),
+			wantErr: "got 2 map leaves",
+		},
+		{
+			desc: "no leaf",
+			faults: getLeaves(func(r *trillian.GetMapLeavesResponse) {
+				r.MapLeafInclusion[0].Leaf = nil
+			}),
+			wantErr: "no leaf",
+		},
+		{
+			desc: "no root",
+			faults: getLeaves(func(r *trillian.GetMapLeavesResponse) {
+				r.MapRoot = nil
+			}),
+			wantErr: "no root",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			tm := testMap(t)
+			for _, f := range tc.faults {
+				tm.AddFault(f)
+			}
+			ui := New(tm, testMapID, UIOpts{})
+
+			inc, smr, err := ui.getLeafByIndex(context.Background(), idx)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("getLeafByIndex(): %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getLeafByIndex(): %v", err)
+			}
+			if got, want := string(inc.Leaf.LeafValue), "1000"; got != want {
+				t.Errorf("getLeafByIndex() value %q, want %q", got, want)
+			}
+			if err := VerifyLeaf(testMapID, inc.Leaf.Index, inc.Leaf.LeafValue, inc.Inclusion, smr); err != nil {
+				t.Errorf("VerifyLeaf(): %v", err)
+			}
+		})
+	}
+}
+
+func TestServeHealthz(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		initialised bool
+		faults      []testonly.Fault
+		wantCode    int
+		wantBody    string
+	}{
+		{desc: "ok", initialised: true, wantCode: http.StatusOK, wantBody: "map revision: 0"},
+		{desc: "uninitialised", wantCode: http.StatusServiceUnavailable, wantBody: "failed to get signed map root"},
+		{
+			desc:        "no root",
+			initialised: true,
+			faults: []testonly.Fault{testonly.RewriteGetSignedMapRoot(0, func(r *trillian.GetSignedMapRootResponse) {
+				r.MapRoot = nil
+			})},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "no root",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			tm := testonly.NewMapClient(testMapID, tc.initialised)
+			for _, f := range tc.faults {
+				tm.AddFault(f)
+			}
+			w := httptest.NewRecorder()
+			New(tm, testMapID, UIOpts{}).ServeHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+			if got := w.Code; got != tc.wantCode {
+				t.Errorf("ServeHealthz() code %d, want %d", got, tc.wantCode)
+			}
+			if got := w.Body.String(); !strings.Contains(got, tc.wantBody) {
+				t.Errorf("ServeHealthz() body %q, want it containing %q", got, tc.wantBody)
+			}
+		})
+	}
+}